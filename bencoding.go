@@ -2,11 +2,14 @@
 package bencode
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"unsafe"
 )
 
@@ -20,15 +23,30 @@ type Marshaler interface {
 	MarshalBEncoding() (string, error)
 }
 
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
 // An UnsupportedTypeError is returned by Marshal when attempting to encode an unsupported value type.
 type UnsupportedTypeError struct {
 	Type reflect.Type
 }
 
 func (e *UnsupportedTypeError) Error() string {
+	if e.Type == nil {
+		return "bencode: unsupported type: <nil>"
+	}
 	return "bencode: unsupported type: " + e.Type.String()
 }
 
+// An UnsupportedValueError is returned by Marshal when attempting to encode a value that has no bencode representation.
+type UnsupportedValueError struct {
+	Value reflect.Value
+	Str   string
+}
+
+func (e *UnsupportedValueError) Error() string {
+	return "bencode: unsupported value: " + e.Str
+}
+
 // Marshal
 func Marshal(v any) (string, error) {
 	var b strings.Builder
@@ -44,19 +62,101 @@ func NewEncoder(w io.Writer) *Encoder {
 	}
 }
 
-// Encode
+// Encode writes the bencoding of v to the stream.
+//
+// Encode traverses v the way encoding/json does: strings and integers encode
+// directly, slices and arrays encode as lists, and map[string]T and structs
+// encode as dictionaries with their keys sorted lexicographically, as BEP 3
+// requires. Struct fields are named by a `bencode:"name,omitempty"` tag,
+// falling back to the Go field name; unexported fields are skipped.
 func (e *Encoder) Encode(v any) error {
-	val := reflect.ValueOf(v)
+	return e.encodeValue(reflect.ValueOf(v), make(map[uintptr]struct{}))
+}
+
+// encodeValue does the actual traversal. seen tracks the addresses of
+// pointers, maps, and slices currently being encoded by an ancestor call,
+// so a self-referential value returns an UnsupportedValueError instead of
+// recursing forever.
+func (e *Encoder) encodeValue(val reflect.Value, seen map[uintptr]struct{}) error {
+	if !val.IsValid() {
+		return &UnsupportedTypeError{Type: nil}
+	}
+
+	if m, ok := asMarshaler(val); ok {
+		s, err := m.MarshalBEncoding()
+		if err != nil {
+			return err
+		}
+		return e.writeString(s)
+	}
+
 	switch val.Kind() {
+	case reflect.Pointer:
+		if val.IsNil() {
+			return &UnsupportedValueError{Value: val, Str: "nil pointer"}
+		}
+		return e.encodeSeen(val, val.Pointer(), seen, func() error {
+			return e.encodeValue(val.Elem(), seen)
+		})
+	case reflect.Interface:
+		if val.IsNil() {
+			return &UnsupportedValueError{Value: val, Str: "nil interface"}
+		}
+		return e.encodeValue(val.Elem(), seen)
 	case reflect.String:
 		return e.encodeString(val)
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
 		return e.encodeInt(val)
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
 		return e.encodeUint(val)
+	case reflect.Slice:
+		if val.Type().Elem().Kind() == reflect.Uint8 {
+			return e.encodeBytes(val)
+		}
+		return e.encodeSeen(val, val.Pointer(), seen, func() error {
+			return e.encodeList(val, seen)
+		})
+	case reflect.Array:
+		return e.encodeList(val, seen)
+	case reflect.Map:
+		return e.encodeSeen(val, val.Pointer(), seen, func() error {
+			return e.encodeDict(val, seen)
+		})
+	case reflect.Struct:
+		return e.encodeStruct(val, seen)
 	default:
-		return &UnsupportedTypeError{Type: reflect.TypeOf(v)}
+		return &UnsupportedTypeError{Type: val.Type()}
+	}
+}
+
+// encodeSeen guards against cycles: if addr is already in seen, it's an
+// ancestor of val in the current recursion, so encoding it would recurse
+// forever. Otherwise it marks addr seen for the duration of encode.
+func (e *Encoder) encodeSeen(val reflect.Value, addr uintptr, seen map[uintptr]struct{}, encode func() error) error {
+	if addr == 0 {
+		// A nil map or slice has no address and can't introduce a
+		// cycle; don't track it.
+		return encode()
+	}
+	if _, ok := seen[addr]; ok {
+		return &UnsupportedValueError{Value: val, Str: "cycle"}
+	}
+	seen[addr] = struct{}{}
+	defer delete(seen, addr)
+	return encode()
+}
+
+// asMarshaler reports whether val (or, if val is addressable, a pointer to
+// it) implements Marshaler, the same way encoding/json consults MarshalJSON
+// before falling back to its built-in type switch.
+func asMarshaler(val reflect.Value) (Marshaler, bool) {
+	if val.Type().Implements(marshalerType) {
+		return val.Interface().(Marshaler), true
+	}
+	if val.CanAddr() && reflect.PointerTo(val.Type()).Implements(marshalerType) {
+		return val.Addr().Interface().(Marshaler), true
 	}
+	return nil, false
 }
 
 func (e *Encoder) writeString(s string) error {
@@ -78,6 +178,27 @@ func (e *Encoder) encodeString(val reflect.Value) error {
 	return e.writeString(ts)
 }
 
+func (e *Encoder) encodeBytes(val reflect.Value) error {
+	b := val.Bytes()
+	if err := e.writeString(strconv.Itoa(len(b)) + ":"); err != nil {
+		return err
+	}
+	_, err := e.w.Write(b)
+	return err
+}
+
+// EncodeStream writes a bencode string of the given length with its payload
+// copied from r, without ever holding the whole value in memory. This is
+// meant for multi-megabyte fields such as a torrent's pieces string, where
+// buffering the value before writing it would be wasteful.
+func (e *Encoder) EncodeStream(length int, r io.Reader) error {
+	if err := e.writeString(strconv.Itoa(length) + ":"); err != nil {
+		return err
+	}
+	_, err := io.CopyN(e.w, r, int64(length))
+	return err
+}
+
 func (e *Encoder) encodeInt(val reflect.Value) error {
 	ns := strconv.FormatInt(val.Int(), 10)
 	ts := "i" + ns + "e"
@@ -90,6 +211,179 @@ func (e *Encoder) encodeUint(val reflect.Value) error {
 	return e.writeString(ts)
 }
 
+func (e *Encoder) encodeList(val reflect.Value, seen map[uintptr]struct{}) error {
+	if err := e.writeString("l"); err != nil {
+		return err
+	}
+	for i := 0; i < val.Len(); i++ {
+		if err := e.encodeValue(val.Index(i), seen); err != nil {
+			return err
+		}
+	}
+	return e.writeString("e")
+}
+
+func (e *Encoder) encodeDict(val reflect.Value, seen map[uintptr]struct{}) error {
+	if val.Type().Key().Kind() != reflect.String {
+		return &UnsupportedTypeError{Type: val.Type()}
+	}
+
+	keys := val.MapKeys()
+	sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+
+	if err := e.writeString("d"); err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := e.encodeString(k); err != nil {
+			return err
+		}
+		if err := e.encodeValue(val.MapIndex(k), seen); err != nil {
+			return err
+		}
+	}
+	return e.writeString("e")
+}
+
+func (e *Encoder) encodeStruct(val reflect.Value, seen map[uintptr]struct{}) error {
+	fields := cachedTypeFields(val.Type())
+
+	if err := e.writeString("d"); err != nil {
+		return err
+	}
+	for _, f := range fields {
+		fv := fieldByIndex(val, f.index)
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if err := e.writeString(strconv.Itoa(len(f.name)) + ":" + f.name); err != nil {
+			return err
+		}
+		if err := e.encodeValue(fv, seen); err != nil {
+			return err
+		}
+	}
+	return e.writeString("e")
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Pointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// A field represents a single struct field found by typeFields.
+type field struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+// fieldCache caches the fields computed for a struct type, keyed by
+// reflect.Type, so repeated encodes/decodes of the same type don't pay for
+// re-walking its fields every time, mirroring encoding/json's fieldCache.
+var fieldCache sync.Map // map[reflect.Type][]field
+
+func cachedTypeFields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	f, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return f.([]field)
+}
+
+// typeFields computes the bencode fields for a struct type, honouring
+// `bencode:"name,omitempty"` tags and skipping unexported fields. Fields are
+// returned sorted by name so dictionaries are written and looked up in the
+// lexicographic key order BEP 3 requires.
+func typeFields(t reflect.Type) []field {
+	var fields []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+
+		name, opts := parseTag(tag)
+		if name == "" {
+			name = sf.Name
+		}
+
+		fields = append(fields, field{
+			name:      name,
+			index:     []int{i},
+			omitEmpty: opts.Contains("omitempty"),
+		})
+	}
+
+	sort.Slice(fields, func(i, j int) bool { return fields[i].name < fields[j].name })
+	return fields
+}
+
+// findField returns the field named name in fields, which must be sorted by
+// name as returned by typeFields, or nil if there is none.
+func findField(fields []field, name string) *field {
+	i := sort.Search(len(fields), func(i int) bool { return fields[i].name >= name })
+	if i < len(fields) && fields[i].name == name {
+		return &fields[i]
+	}
+	return nil
+}
+
+func fieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for _, i := range index {
+		v = v.Field(i)
+	}
+	return v
+}
+
+// tagOptions is the comma-separated options following a struct tag's name,
+// e.g. "omitempty" in `bencode:"name,omitempty"`.
+type tagOptions string
+
+func parseTag(tag string) (string, tagOptions) {
+	name, opts, _ := strings.Cut(tag, ",")
+	return name, tagOptions(opts)
+}
+
+func (o tagOptions) Contains(optName string) bool {
+	if o == "" {
+		return false
+	}
+	s := string(o)
+	for s != "" {
+		var next string
+		if i := strings.Index(s, ","); i >= 0 {
+			s, next = s[:i], s[i+1:]
+		}
+		if s == optName {
+			return true
+		}
+		s = next
+	}
+	return false
+}
+
+// defaultMaxDepth is the default Decoder.SetMaxDepth limit.
+const defaultMaxDepth = 10000
+
 // Decoder
 type Decoder struct {
 	src io.Reader
@@ -98,6 +392,27 @@ type Decoder struct {
 	buf        []byte
 	start, cur int   // idxs in buf
 	offset     int64 // global offset in src
+	capture    *[]byte
+
+	maxDepth int
+	depth    int
+}
+
+// A MaxDepthError is returned by Decode when a bencoded value nests lists
+// and dictionaries deeper than Decoder.SetMaxDepth allows, guarding against
+// a maliciously crafted input exhausting the goroutine stack.
+type MaxDepthError struct {
+	MaxDepth int
+}
+
+func (e *MaxDepthError) Error() string {
+	return "bencode: exceeded max depth of " + strconv.Itoa(e.MaxDepth)
+}
+
+// SetMaxDepth sets the maximum nesting depth of lists and dictionaries that
+// Decode will accept. The default is 10000.
+func (d *Decoder) SetMaxDepth(depth int) {
+	d.maxDepth = depth
 }
 
 // Unmarshaler
@@ -105,6 +420,32 @@ type Unmarshaler interface {
 	UnmarshalBEncoding(string) error
 }
 
+// RawMessage is a raw encoded bencode value, analogous to json.RawMessage.
+// It can be used to delay decoding of part of a value, or to precompute a
+// bencoding, and it implements Marshaler and Unmarshaler so it passes
+// through Encode/Decode verbatim.
+//
+// The motivating use case is computing a torrent's SHA-1 info hash: decode
+// into a struct with an Info RawMessage field tagged `bencode:"info"`, then
+// hash Info directly instead of re-encoding the decoded value and risking a
+// non-canonical round trip.
+type RawMessage []byte
+
+// MarshalBEncoding returns m verbatim.
+func (m RawMessage) MarshalBEncoding() (string, error) {
+	return string(m), nil
+}
+
+// UnmarshalBEncoding sets *m to a copy of data.
+func (m *RawMessage) UnmarshalBEncoding(data string) error {
+	*m = RawMessage(data)
+	return nil
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+var ioWriterType = reflect.TypeOf((*io.Writer)(nil)).Elem()
+
 // Unmarshal
 func Unmarshal(s string, v any) error {
 	dec := NewDecoder(strings.NewReader(s))
@@ -121,6 +462,21 @@ func (e *UnmarshalTypeError) Error() string {
 	return "bencode: cannot unmarshal " + e.Value + " into Go value of type " + e.Type.String()
 }
 
+// An InvalidUnmarshalError describes an invalid argument passed to Decode. The argument to Decode must be a non-nil pointer.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: Decode(nil)"
+	}
+	if e.Type.Kind() != reflect.Pointer {
+		return "bencode: Decode(non-pointer " + e.Type.String() + ")"
+	}
+	return "bencode: Decode(nil " + e.Type.String() + ")"
+}
+
 // A SyntaxError is a description of a bencoding syntax error.
 type SyntaxError struct {
 	Offset int64  // error occurred after read Offset byts
@@ -137,6 +493,7 @@ func NewDecoder(r io.Reader) *Decoder {
 		src:        r,
 		minBufSize: 512,
 		buf:        make([]byte, 0, 512), // same initial buffer size used in io.ReadAll
+		maxDepth:   defaultMaxDepth,
 	}
 }
 
@@ -161,11 +518,28 @@ func (d *Decoder) next() (byte, error) {
 	}
 	char := d.buf[d.cur]
 	d.cur += 1
+	d.offset += 1
+	if d.capture != nil {
+		*d.capture = append(*d.capture, char)
+	}
 	return char, nil
 }
 
 func (d *Decoder) backup() {
 	d.cur -= 1
+	d.offset -= 1
+	if d.capture != nil {
+		*d.capture = (*d.capture)[:len(*d.capture)-1]
+	}
+}
+
+func (d *Decoder) peek() (byte, error) {
+	c, err := d.next()
+	if err != nil {
+		return 0, err
+	}
+	d.backup()
+	return c, nil
 }
 
 func (d *Decoder) ignore() {
@@ -186,10 +560,41 @@ func (d *Decoder) slice() []byte {
 	return b
 }
 
-// Decode
+// Decode reads the next bencoded value from its input and stores it in the
+// value pointed to by v.
+//
+// Decode traverses v the way encoding/json does: v must be a non-nil
+// pointer. Lists decode into slices and arrays, dictionaries decode into
+// map[string]T or structs (matched against a `bencode:"name"` tag, falling
+// back to the Go field name), and an any/interface{} target decodes into a
+// string, int64, []any, or map[string]any depending on what was read.
 func (d *Decoder) Decode(v any) error {
 	defer d.resetBuffer()
 
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return &InvalidUnmarshalError{Type: reflect.TypeOf(v)}
+	}
+
+	return d.decodeValue(rv.Elem())
+}
+
+func (d *Decoder) decodeValue(rv reflect.Value) error {
+	if rv.Kind() == reflect.Pointer {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		return d.decodeValue(rv.Elem())
+	}
+
+	if rv.CanAddr() && reflect.PointerTo(rv.Type()).Implements(unmarshalerType) {
+		raw, err := d.captureRaw()
+		if err != nil {
+			return err
+		}
+		return rv.Addr().Interface().(Unmarshaler).UnmarshalBEncoding(bytesToString(raw))
+	}
+
 	char, err := d.next()
 	if err == io.EOF {
 		return io.ErrUnexpectedEOF
@@ -198,35 +603,47 @@ func (d *Decoder) Decode(v any) error {
 		return err
 	}
 
-	switch char {
-	case 'i':
-		return d.decodeInt(v)
-	case 'l':
-		return d.decodeList(v)
-	case 'd':
-		return nil
-	case '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
-		return d.decodeString(v)
+	switch {
+	case char == 'i':
+		return d.decodeInt(rv)
+	case char == 'l':
+		return d.decodeList(rv)
+	case char == 'd':
+		return d.decodeDict(rv)
+	case isDigit(char):
+		return d.decodeString(rv)
 	default:
 		return &SyntaxError{
-			msg: fmt.Sprintf("unexpected byte: %d", char),
+			Offset: d.offset,
+			msg:    fmt.Sprintf("unexpected byte: %d", char),
 		}
 	}
 }
 
-func (d *Decoder) decodeString(v any) error {
-	// TODO: support []byte since technically UTF8 is not gauranteed
-	var s *string
-	switch x := v.(type) {
-	case *string:
-		s = x
-	default:
-		return &UnmarshalTypeError{
-			Value: "string " + string(d.buf),
-			Type:  reflect.TypeOf(v),
-		}
+// captureRaw decodes and discards the next bencoded value, returning the
+// exact input bytes it consumed. This is what lets RawMessage and other
+// Unmarshaler implementations get at the raw bencoding of a value instead
+// of a decoded Go representation of it.
+func (d *Decoder) captureRaw() ([]byte, error) {
+	var raw []byte
+	prevCapture := d.capture
+	d.capture = &raw
+	err := d.skipValue()
+	d.capture = prevCapture
+	if err != nil {
+		return nil, err
 	}
+	return raw, nil
+}
 
+// skipValue consumes and discards the next bencoded value, used to skip
+// over dict entries whose key doesn't match any destination struct field.
+func (d *Decoder) skipValue() error {
+	var discard any
+	return d.decodeValue(reflect.ValueOf(&discard).Elem())
+}
+
+func (d *Decoder) decodeString(rv reflect.Value) error {
 	length, err := d.scanLength()
 	if err != nil {
 		return err
@@ -241,7 +658,77 @@ func (d *Decoder) decodeString(v any) error {
 		}
 	}
 
-	*s = bytesToString(d.slice())
+	s := bytesToString(d.slice())
+
+	switch {
+	case rv.Kind() == reflect.String:
+		rv.SetString(s)
+	case rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8:
+		rv.SetBytes([]byte(s))
+	case rv.Kind() == reflect.Interface && rv.NumMethod() == 0:
+		rv.Set(reflect.ValueOf(s))
+	default:
+		return &UnmarshalTypeError{
+			Value: "string " + s,
+			Type:  rv.Type(),
+		}
+	}
+	return nil
+}
+
+// decodeStreamedString reads the length-prefixed string that follows and
+// copies its payload directly to w, bypassing the buffer growth in next()
+// so peak memory stays O(minBufSize) regardless of the string's length.
+// It's used for struct fields typed as io.Writer, so a multi-megabyte
+// field such as a torrent's pieces string never has to be buffered whole.
+func (d *Decoder) decodeStreamedString(w io.Writer) error {
+	c, err := d.next()
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return err
+	}
+	if !isDigit(c) {
+		return &SyntaxError{
+			Offset: d.offset,
+			msg:    fmt.Sprintf("unexpected byte: %d", c),
+		}
+	}
+
+	length, err := d.scanLength()
+	if err != nil {
+		return err
+	}
+	// consume colon
+	d.next()
+	d.ignore() // ignore colon
+
+	remaining := length
+	if avail := len(d.buf) - d.cur; avail > 0 {
+		n := uint64(avail)
+		if n > remaining {
+			n = remaining
+		}
+		if _, err := w.Write(d.buf[d.cur : d.cur+int(n)]); err != nil {
+			return err
+		}
+		d.cur += int(n)
+		d.offset += int64(n)
+		remaining -= n
+	}
+	d.ignore()
+
+	if remaining > 0 {
+		n, err := io.CopyN(w, d.src, int64(remaining))
+		d.offset += n
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -273,22 +760,12 @@ func (d *Decoder) scanLength() (uint64, error) {
 	return length, nil
 }
 
-func (d *Decoder) decodeInt(v any) error {
-	var i *int
-	switch x := v.(type) {
-	case *int:
-		i = x
-	default:
-		return &UnmarshalTypeError{
-			Value: "int " + string(d.buf),
-			Type:  reflect.TypeOf(v),
-		}
-	}
-
+func (d *Decoder) decodeInt(rv reflect.Value) error {
 	d.ignore() // ignore 'i'
 
 	isNegative := false
-	hasLeadingZero := false
+	digits := 0
+	leadingZero := false
 intLoop:
 	for {
 		c, err := d.next()
@@ -302,17 +779,10 @@ intLoop:
 			d.backup()
 			break intLoop
 		case isDigit(c):
-			if c == '0' && !isNegative {
-				hasLeadingZero = true
-				break
-			}
-			if c == '0' && isNegative {
-				return &SyntaxError{
-					Offset: d.offset,
-					msg:    "negative zero is an invalid integer",
-				}
-			}
-			if hasLeadingZero {
+			digits++
+			if digits == 1 {
+				leadingZero = c == '0'
+			} else if leadingZero {
 				return &SyntaxError{
 					Offset: d.offset,
 					msg:    "integer can not start with a leading zero",
@@ -325,9 +795,15 @@ intLoop:
 			}
 		}
 	}
+	if leadingZero && isNegative {
+		return &SyntaxError{
+			Offset: d.offset,
+			msg:    "negative zero is an invalid integer",
+		}
+	}
 
 	b := d.slice()
-	n, err := strconv.ParseInt(bytesToString(b), 10, 0)
+	n, err := strconv.ParseInt(bytesToString(b), 10, 64)
 	if err != nil {
 		return err
 	}
@@ -336,16 +812,468 @@ intLoop:
 	d.next()
 	d.ignore()
 
-	*i = int(n)
+	switch {
+	case rv.Kind() == reflect.Int, rv.Kind() == reflect.Int8, rv.Kind() == reflect.Int16, rv.Kind() == reflect.Int32, rv.Kind() == reflect.Int64:
+		if rv.OverflowInt(n) {
+			return &UnmarshalTypeError{Value: "int " + strconv.FormatInt(n, 10), Type: rv.Type()}
+		}
+		rv.SetInt(n)
+	case rv.Kind() == reflect.Uint, rv.Kind() == reflect.Uint8, rv.Kind() == reflect.Uint16, rv.Kind() == reflect.Uint32, rv.Kind() == reflect.Uint64:
+		if n < 0 || rv.OverflowUint(uint64(n)) {
+			return &UnmarshalTypeError{Value: "int " + strconv.FormatInt(n, 10), Type: rv.Type()}
+		}
+		rv.SetUint(uint64(n))
+	case rv.Kind() == reflect.Interface && rv.NumMethod() == 0:
+		rv.Set(reflect.ValueOf(n))
+	default:
+		return &UnmarshalTypeError{
+			Value: "int " + strconv.FormatInt(n, 10),
+			Type:  rv.Type(),
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) enterNesting() error {
+	d.depth++
+	if d.depth > d.maxDepth {
+		return &MaxDepthError{MaxDepth: d.maxDepth}
+	}
 	return nil
 }
 
-func (d *Decoder) decodeList(v any) error {
+func (d *Decoder) leaveNesting() {
+	d.depth--
+}
+
+func (d *Decoder) decodeList(rv reflect.Value) error {
 	d.ignore() // ignore 'l'
 
+	if err := d.enterNesting(); err != nil {
+		return err
+	}
+	defer d.leaveNesting()
+
+	switch {
+	case rv.Kind() == reflect.Interface && rv.NumMethod() == 0:
+		list, err := d.decodeAnyList()
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(list))
+		return nil
+	case rv.Kind() == reflect.Slice:
+		rv.Set(rv.Slice(0, 0))
+		for {
+			more, err := d.listHasMore()
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := d.decodeValue(elem); err != nil {
+				return err
+			}
+			rv.Set(reflect.Append(rv, elem))
+		}
+	case rv.Kind() == reflect.Array:
+		i := 0
+		for {
+			more, err := d.listHasMore()
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+			if i < rv.Len() {
+				if err := d.decodeValue(rv.Index(i)); err != nil {
+					return err
+				}
+			} else if err := d.skipValue(); err != nil {
+				return err
+			}
+			i++
+		}
+	default:
+		return &UnmarshalTypeError{Value: "list", Type: rv.Type()}
+	}
+}
+
+func (d *Decoder) decodeAnyList() ([]any, error) {
+	list := []any{}
+	for {
+		more, err := d.listHasMore()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return list, nil
+		}
+		var elem any
+		if err := d.decodeValue(reflect.ValueOf(&elem).Elem()); err != nil {
+			return nil, err
+		}
+		list = append(list, elem)
+	}
+}
+
+// listHasMore reports whether another element follows in the list or dict
+// currently being decoded, consuming the closing 'e' if not.
+func (d *Decoder) listHasMore() (bool, error) {
+	c, err := d.next()
+	if err == io.EOF {
+		return false, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return false, err
+	}
+	if c == 'e' {
+		d.ignore()
+		return false, nil
+	}
+	d.backup()
+	return true, nil
+}
+
+func (d *Decoder) decodeDict(rv reflect.Value) error {
+	d.ignore() // ignore 'd'
+
+	if err := d.enterNesting(); err != nil {
+		return err
+	}
+	defer d.leaveNesting()
+
+	switch {
+	case rv.Kind() == reflect.Interface && rv.NumMethod() == 0:
+		m, err := d.decodeAnyDict()
+		if err != nil {
+			return err
+		}
+		rv.Set(reflect.ValueOf(m))
+		return nil
+	case rv.Kind() == reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return &UnmarshalTypeError{Value: "dict", Type: rv.Type()}
+		}
+		if rv.IsNil() {
+			rv.Set(reflect.MakeMap(rv.Type()))
+		}
+		for {
+			key, more, err := d.dictNextKey()
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+			elem := reflect.New(rv.Type().Elem()).Elem()
+			if err := d.decodeValue(elem); err != nil {
+				return err
+			}
+			rv.SetMapIndex(reflect.ValueOf(key).Convert(rv.Type().Key()), elem)
+		}
+	case rv.Kind() == reflect.Struct:
+		fields := cachedTypeFields(rv.Type())
+		for {
+			key, more, err := d.dictNextKey()
+			if err != nil {
+				return err
+			}
+			if !more {
+				return nil
+			}
+			f := findField(fields, key)
+			if f == nil {
+				if err := d.skipValue(); err != nil {
+					return err
+				}
+				continue
+			}
+			fv := fieldByIndex(rv, f.index)
+			if fv.Kind() == reflect.Interface && fv.Type() == ioWriterType && !fv.IsNil() {
+				if err := d.decodeStreamedString(fv.Interface().(io.Writer)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decodeValue(fv); err != nil {
+				return err
+			}
+		}
+	default:
+		return &UnmarshalTypeError{Value: "dict", Type: rv.Type()}
+	}
+}
+
+func (d *Decoder) decodeAnyDict() (map[string]any, error) {
+	m := map[string]any{}
+	for {
+		key, more, err := d.dictNextKey()
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			return m, nil
+		}
+		var elem any
+		if err := d.decodeValue(reflect.ValueOf(&elem).Elem()); err != nil {
+			return nil, err
+		}
+		m[key] = elem
+	}
+}
+
+// dictNextKey reads the next dict key, or reports more == false once the
+// closing 'e' is reached. Dict keys are always bencode strings per BEP 3.
+func (d *Decoder) dictNextKey() (key string, more bool, err error) {
+	c, err := d.next()
+	if err == io.EOF {
+		return "", false, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if c == 'e' {
+		d.ignore()
+		return "", false, nil
+	}
+	if !isDigit(c) {
+		return "", false, &SyntaxError{
+			Offset: d.offset,
+			msg:    fmt.Sprintf("expected string key in dict, not: %d", c),
+		}
+	}
+
+	var k string
+	if err := d.decodeString(reflect.ValueOf(&k).Elem()); err != nil {
+		return "", false, err
+	}
+	return k, true, nil
+}
+
+// ListStart is the token returned by Token when a list ("l") begins.
+type ListStart struct{}
+
+// DictStart is the token returned by Token when a dictionary ("d") begins.
+type DictStart struct{}
+
+// End is the token returned by Token when a list or dictionary ("e") ends.
+type End struct{}
+
+// Token returns the next low-level bencoding token in the input stream:
+// an int64, a string, or one of the delimiter values ListStart, DictStart,
+// and End. It lets a caller walk a bencoded value, such as a .torrent
+// file's info dictionary, without materializing the whole structure, the
+// way encoding/json's Decoder.Token does for JSON.
+//
+// Callers use More to decide whether to keep reading elements of a list or
+// dictionary started by a ListStart/DictStart token; the matching End token
+// must still be read with a final call to Token.
+func (d *Decoder) Token() (any, error) {
+	c, err := d.next()
+	if err == io.EOF {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c == 'i':
+		return d.tokenInt()
+	case c == 'l':
+		d.ignore()
+		return ListStart{}, nil
+	case c == 'd':
+		d.ignore()
+		return DictStart{}, nil
+	case c == 'e':
+		d.ignore()
+		return End{}, nil
+	case isDigit(c):
+		return d.tokenString()
+	default:
+		return nil, &SyntaxError{
+			Offset: d.offset,
+			msg:    fmt.Sprintf("unexpected byte: %d", c),
+		}
+	}
+}
+
+func (d *Decoder) tokenInt() (any, error) {
+	var n int64
+	if err := d.decodeInt(reflect.ValueOf(&n).Elem()); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (d *Decoder) tokenString() (any, error) {
+	var s string
+	if err := d.decodeString(reflect.ValueOf(&s).Elem()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// More reports whether there is another element before the end of the list
+// or dictionary currently being read via Token. It does not consume input.
+func (d *Decoder) More() bool {
+	c, err := d.peek()
+	if err != nil {
+		return false
+	}
+	return c != 'e'
+}
+
+// InputOffset returns the byte offset of the current decoder position in
+// the input stream, for correlating a Token with its location in, for
+// example, the original .torrent file bytes.
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+// Valid reports whether s is a single bencode value in BEP 3's canonical
+// form: dictionary keys sorted lexicographically with no duplicates, and
+// integers with no leading zeros or negative zero. Unlike json.Valid,
+// bencode has exactly one valid encoding per value, so Valid rejects
+// anything Canonicalize would have to rewrite, not just malformed input.
+func Valid(s string) error {
+	canon, err := Canonicalize([]byte(s))
+	if err != nil {
+		return err
+	}
+	if string(canon) != s {
+		return &SyntaxError{msg: "bencode: not in canonical form"}
+	}
 	return nil
 }
 
+// Canonicalize parses src as a single bencode value and re-emits it in
+// BEP 3's canonical form: dictionary keys sorted lexicographically with
+// no duplicates. It's the bencode analogue of json.Compact, and is meant
+// for verifying that a received info dict matches its advertised hash
+// without trusting the sender to have encoded it canonically.
+func Canonicalize(src []byte) ([]byte, error) {
+	dec := NewDecoder(bytes.NewReader(src))
+	canon, err := dec.canonicalValue()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.next(); err != io.EOF {
+		return nil, &SyntaxError{Offset: dec.offset, msg: "bencode: unexpected trailing data"}
+	}
+	return []byte(canon), nil
+}
+
+// canonicalValue decodes the next bencode value and returns its canonical
+// encoding, sorting dict keys and rejecting duplicates along the way. It
+// reuses decodeInt/decodeString/dictNextKey so the leading-zero,
+// negative-zero, and framing checks they already perform on decode don't
+// need to be duplicated here.
+func (d *Decoder) canonicalValue() (string, error) {
+	c, err := d.next()
+	if err == io.EOF {
+		return "", io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case c == 'i':
+		var n int64
+		if err := d.decodeInt(reflect.ValueOf(&n).Elem()); err != nil {
+			return "", err
+		}
+		return "i" + strconv.FormatInt(n, 10) + "e", nil
+	case c == 'l':
+		d.ignore() // ignore 'l'
+		if err := d.enterNesting(); err != nil {
+			return "", err
+		}
+		defer d.leaveNesting()
+
+		var sb strings.Builder
+		sb.WriteByte('l')
+		for {
+			more, err := d.listHasMore()
+			if err != nil {
+				return "", err
+			}
+			if !more {
+				break
+			}
+			elem, err := d.canonicalValue()
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(elem)
+		}
+		sb.WriteByte('e')
+		return sb.String(), nil
+	case c == 'd':
+		d.ignore() // ignore 'd'
+		if err := d.enterNesting(); err != nil {
+			return "", err
+		}
+		defer d.leaveNesting()
+
+		type dictEntry struct {
+			key string
+			val string
+		}
+		var entries []dictEntry
+		for {
+			key, more, err := d.dictNextKey()
+			if err != nil {
+				return "", err
+			}
+			if !more {
+				break
+			}
+			val, err := d.canonicalValue()
+			if err != nil {
+				return "", err
+			}
+			entries = append(entries, dictEntry{key, val})
+		}
+
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		for i := 1; i < len(entries); i++ {
+			if entries[i].key == entries[i-1].key {
+				return "", &SyntaxError{
+					Offset: d.offset,
+					msg:    "bencode: duplicate dict key: " + entries[i].key,
+				}
+			}
+		}
+
+		var sb strings.Builder
+		sb.WriteByte('d')
+		for _, e := range entries {
+			sb.WriteString(strconv.Itoa(len(e.key)) + ":" + e.key)
+			sb.WriteString(e.val)
+		}
+		sb.WriteByte('e')
+		return sb.String(), nil
+	case isDigit(c):
+		var s string
+		if err := d.decodeString(reflect.ValueOf(&s).Elem()); err != nil {
+			return "", err
+		}
+		return strconv.Itoa(len(s)) + ":" + s, nil
+	default:
+		return "", &SyntaxError{
+			Offset: d.offset,
+			msg:    fmt.Sprintf("unexpected byte: %d", c),
+		}
+	}
+}
+
 func isDigit(b byte) bool {
 	return b == '0' || b == '1' || b == '2' || b == '3' || b == '4' || b == '5' || b == '6' || b == '7' || b == '8' || b == '9'
 }
@@ -1,11 +1,22 @@
 package bencode
 
 import (
+	"bytes"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
+type testStruct struct {
+	Name  string `bencode:"name"`
+	Count int    `bencode:"count,omitempty"`
+	skip  string
+}
+
 func TestMarshalAndUnmarshal(t *testing.T) {
 	testCases := []struct {
 		Name     string
@@ -37,30 +48,66 @@ func TestMarshalAndUnmarshal(t *testing.T) {
 			Encoding: "i-123e",
 			Out:      new(int),
 		},
-		// {
-		// 	Name:     "list of strings",
-		// 	Value:    []string{"1", "2", "3"},
-		// 	Encoding: "l1:11:21:3e",
-		// 	Out:      new([]string),
-		// },
-		// {
-		// 	Name:     "list of ints",
-		// 	Value:    []int{1, 2, 3},
-		// 	Encoding: "li1ei2ei3ee",
-		// 	Out:      new([]int),
-		// },
-		// {
-		// 	Name:     "heterogenous list",
-		// 	Value:    []interface{}{1, "hello"},
-		// 	Encoding: "li1e5:helloe",
-		// 	Out:      new([]interface{}),
-		// },
-		// {
-		// 	Name:     "list of lists",
-		// 	Value:    [][]int{{1, 0}, {0, 1}},
-		// 	Encoding: "lli1ei0eeli0ei1eee",
-		// 	Out:      new([]int),
-		// },
+		{
+			Name:     "integer with internal zero digit",
+			Value:    105,
+			Encoding: "i105e",
+			Out:      new(int),
+		},
+		{
+			Name:     "piece-length-sized integer with internal zero digit",
+			Value:    1048576,
+			Encoding: "i1048576e",
+			Out:      new(int),
+		},
+		{
+			Name:     "negative integer with internal zero digit",
+			Value:    -100,
+			Encoding: "i-100e",
+			Out:      new(int),
+		},
+		{
+			Name:     "list of strings",
+			Value:    []string{"1", "2", "3"},
+			Encoding: "l1:11:21:3e",
+			Out:      new([]string),
+		},
+		{
+			Name:     "list of ints",
+			Value:    []int{1, 2, 3},
+			Encoding: "li1ei2ei3ee",
+			Out:      new([]int),
+		},
+		{
+			Name:     "heterogenous list",
+			Value:    []interface{}{int64(1), "hello"},
+			Encoding: "li1e5:helloe",
+			Out:      new([]interface{}),
+		},
+		{
+			Name:     "list of lists",
+			Value:    [][]int{{1, 0}, {0, 1}},
+			Encoding: "lli1ei0eeli0ei1eee",
+			Out:      new([][]int),
+		},
+		{
+			Name:     "map of strings",
+			Value:    map[string]string{"a": "1", "b": "2"},
+			Encoding: "d1:a1:11:b1:2e",
+			Out:      new(map[string]string),
+		},
+		{
+			Name:     "struct with tags",
+			Value:    testStruct{Name: "hello", Count: 3},
+			Encoding: "d5:counti3e4:name5:helloe",
+			Out:      new(testStruct),
+		},
+		{
+			Name:     "struct with omitted field",
+			Value:    testStruct{Name: "hello"},
+			Encoding: "d4:name5:helloe",
+			Out:      new(testStruct),
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -141,6 +188,16 @@ func TestUnmarshal(t *testing.T) {
 				Value: "i-0e",
 				Out:   new(int),
 			},
+			{
+				Name:  "all-zero digit run",
+				Value: "i00e",
+				Out:   new(int),
+			},
+			{
+				Name:  "longer all-zero digit run",
+				Value: "i000e",
+				Out:   new(int),
+			},
 		}
 
 		for _, testCase := range testCases {
@@ -158,13 +215,271 @@ func TestUnmarshal(t *testing.T) {
 	})
 }
 
+func TestDecoderToken(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("ld3:fooi1ee5:helloe"))
+
+	tok, err := dec.Token()
+	if !assert.Nil(t, err) || !assert.Equal(t, ListStart{}, tok) {
+		return
+	}
+
+	var elems []any
+	for dec.More() {
+		tok, err := dec.Token()
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		if tok == (DictStart{}) {
+			var pairs []any
+			for dec.More() {
+				key, err := dec.Token()
+				if !assert.Nil(t, err) {
+					return
+				}
+				val, err := dec.Token()
+				if !assert.Nil(t, err) {
+					return
+				}
+				pairs = append(pairs, key, val)
+			}
+			end, err := dec.Token()
+			if !assert.Nil(t, err) || !assert.Equal(t, End{}, end) {
+				return
+			}
+			elems = append(elems, pairs)
+			continue
+		}
+
+		elems = append(elems, tok)
+	}
+
+	end, err := dec.Token()
+	if !assert.Nil(t, err) || !assert.Equal(t, End{}, end) {
+		return
+	}
+
+	assert.Equal(t, []any{[]any{"foo", int64(1)}, "hello"}, elems)
+
+	_, err = dec.Token()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDecoderInputOffset(t *testing.T) {
+	dec := NewDecoder(strings.NewReader("i1e5:hello"))
+
+	_, err := dec.Token()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(3), dec.InputOffset())
+
+	_, err = dec.Token()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, int64(10), dec.InputOffset())
+}
+
+// upperString is a Marshaler/Unmarshaler that upper-cases on encode and
+// lower-cases on decode, so round-tripping it through the default string
+// codec would produce a different result than going through the interfaces.
+type upperString string
+
+func (s upperString) MarshalBEncoding() (string, error) {
+	up := strings.ToUpper(string(s))
+	return strconv.Itoa(len(up)) + ":" + up, nil
+}
+
+func (s *upperString) UnmarshalBEncoding(data string) error {
+	var raw string
+	if err := Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*s = upperString(strings.ToLower(raw))
+	return nil
+}
+
+func TestMarshalerUnmarshaler(t *testing.T) {
+	s, err := Marshal(upperString("hi"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "2:HI", s)
+
+	var out upperString
+	err = Unmarshal("2:HI", &out)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, upperString("hi"), out)
+}
+
+func TestDecoderMaxDepth(t *testing.T) {
+	dec := NewDecoder(strings.NewReader(strings.Repeat("l", 5) + "1:x" + strings.Repeat("e", 5)))
+	dec.SetMaxDepth(3)
+
+	var out any
+	err := dec.Decode(&out)
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.IsType(t, &MaxDepthError{}, err)
+}
+
+func TestMarshalNil(t *testing.T) {
+	_, err := Marshal(nil)
+	if !assert.Error(t, err) {
+		return
+	}
+	if !assert.IsType(t, &UnsupportedTypeError{}, err) {
+		return
+	}
+	assert.NotPanics(t, func() { _ = err.Error() })
+}
+
+func TestEncodeCycle(t *testing.T) {
+	m := map[string]any{}
+	m["self"] = m
+
+	_, err := Marshal(m)
+	if !assert.Error(t, err) {
+		return
+	}
+	assert.IsType(t, &UnsupportedValueError{}, err)
+}
+
+func TestEncodeStream(t *testing.T) {
+	var b strings.Builder
+	enc := NewEncoder(&b)
+
+	err := enc.EncodeStream(5, strings.NewReader("hello"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "5:hello", b.String())
+}
+
+func TestDecodeStreamedString(t *testing.T) {
+	var pieces bytes.Buffer
+	target := struct {
+		Pieces io.Writer `bencode:"pieces"`
+	}{Pieces: &pieces}
+
+	err := Unmarshal("d6:pieces10:0123456789e", &target)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "0123456789", pieces.String())
+}
+
+func TestDecodePointerField(t *testing.T) {
+	type withPointer struct {
+		N *int `bencode:"n"`
+	}
+
+	n := 5
+	s, err := Marshal(withPointer{N: &n})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "d1:ni5ee", s)
+
+	var out withPointer
+	err = Unmarshal(s, &out)
+	if !assert.Nil(t, err) {
+		return
+	}
+	if !assert.NotNil(t, out.N) {
+		return
+	}
+	assert.Equal(t, 5, *out.N)
+}
+
+func TestRawMessage(t *testing.T) {
+	var torrent struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+	}
+
+	err := Unmarshal("d8:announce9:localhost4:infod4:name3:foo6:lengthi10eee", &torrent)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	assert.Equal(t, "localhost", torrent.Announce)
+	assert.Equal(t, RawMessage("d4:name3:foo6:lengthi10ee"), torrent.Info)
+
+	s, err := torrent.Info.MarshalBEncoding()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, "d4:name3:foo6:lengthi10ee", s)
+}
+
+func TestValid(t *testing.T) {
+	testCases := []struct {
+		Name  string
+		Value string
+		Valid bool
+	}{
+		{Name: "string", Value: "5:hello", Valid: true},
+		{Name: "integer", Value: "i123e", Valid: true},
+		{Name: "piece-length-sized integer with internal zero digit", Value: "i1048576e", Valid: true},
+		{Name: "nested list and dict", Value: "ld1:ai1e1:bi2eee", Valid: true},
+		{Name: "sorted dict keys", Value: "d1:ai1e1:bi2ee", Valid: true},
+		{Name: "unsorted dict keys", Value: "d1:bi2e1:ai1ee", Valid: false},
+		{Name: "duplicate dict keys", Value: "d1:ai1e1:ai2ee", Valid: false},
+		{Name: "leading zero", Value: "i03e", Valid: false},
+		{Name: "negative zero", Value: "i-0e", Valid: false},
+		{Name: "trailing data", Value: "i1ei2e", Valid: false},
+		{Name: "malformed", Value: "hello", Valid: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			err := Valid(testCase.Value)
+			if testCase.Valid {
+				assert.Nil(subT, err)
+			} else {
+				assert.Error(subT, err)
+			}
+		})
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Src  string
+		Want string
+	}{
+		{Name: "already canonical", Src: "d1:ai1e1:bi2ee", Want: "d1:ai1e1:bi2ee"},
+		{Name: "unsorted dict keys", Src: "d1:bi2e1:ai1ee", Want: "d1:ai1e1:bi2ee"},
+		{Name: "nested unsorted dict", Src: "ld1:bi2e1:ai1eee", Want: "ld1:ai1e1:bi2eee"},
+		{Name: "piece-length-sized integer with internal zero digit", Src: "i1048576e", Want: "i1048576e"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			got, err := Canonicalize([]byte(testCase.Src))
+			if !assert.Nil(subT, err) {
+				return
+			}
+			assert.Equal(subT, testCase.Want, string(got))
+		})
+	}
+
+	t.Run("duplicate dict keys", func(subT *testing.T) {
+		_, err := Canonicalize([]byte("d1:ai1e1:ai2ee"))
+		assert.Error(subT, err)
+	})
+}
+
 func unref(v any) any {
-	switch x := v.(type) {
-	case *string:
-		return *x
-	case *int:
-		return *x
-	default:
-		return x
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer {
+		return rv.Elem().Interface()
 	}
+	return v
 }